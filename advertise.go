@@ -0,0 +1,88 @@
+package tscaddy
+
+// advertise.go turns a tsnet node into a first-class tailnet participant by
+// applying its advertised tags, subnet routes, exit-node status, and
+// accept-routes setting once the node comes up, rather than leaving it as a
+// listener-only endpoint.
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"tailscale.com/ipn"
+)
+
+// exitNodeRoutes are the two routes that advertise a node as an exit node,
+// matching what the Tailscale CLI advertises for --advertise-exit-node.
+var exitNodeRoutes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/0"),
+	netip.MustParsePrefix("::/0"),
+}
+
+// configureAdvertising applies the node's advertise_tags, advertise_routes,
+// advertise_exit_node, accept_routes, and advertise_services config via
+// LocalClient.EditPrefs. It's a no-op if none of those are configured for
+// the node.
+func configureAdvertising(ctx context.Context, s *tailscaleNode, name string, app *App) error {
+	node, ok := app.Nodes[name]
+	if !ok {
+		return nil
+	}
+
+	mp, err := buildAdvertisePrefs(node.AdvertiseTags, node.AdvertiseRoutes, node.AdvertiseExitNode, node.AcceptRoutes, node.AdvertiseServices)
+	if err != nil {
+		return fmt.Errorf("building advertise prefs for node %q: %w", name, err)
+	}
+	if mp == nil {
+		return nil
+	}
+
+	lc, err := s.LocalClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = lc.EditPrefs(ctx, mp)
+	return err
+}
+
+// buildAdvertisePrefs translates advertise_* node config into the
+// ipn.MaskedPrefs sent to LocalClient.EditPrefs, or (nil, nil) if none of
+// it is configured. Split out from configureAdvertising so the translation
+// can be unit tested without a live tsnet node.
+func buildAdvertisePrefs(tags []string, routeCIDRs []string, exitNode, acceptRoutes bool, services []string) (*ipn.MaskedPrefs, error) {
+	if len(tags) == 0 && len(routeCIDRs) == 0 && !exitNode && !acceptRoutes && len(services) == 0 {
+		return nil, nil
+	}
+
+	routes := make([]netip.Prefix, 0, len(routeCIDRs))
+	for _, r := range routeCIDRs {
+		p, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("parsing advertise_routes %q: %w", r, err)
+		}
+		routes = append(routes, p)
+	}
+	if exitNode {
+		routes = append(routes, exitNodeRoutes...)
+	}
+
+	return &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			AdvertiseTags:   tags,
+			AdvertiseRoutes: routes,
+			RouteAll:        acceptRoutes,
+			AppConnector: ipn.AppConnectorPrefs{
+				// The actual set of advertised services is defined in the
+				// tailnet's ACLs; this just opts the node into being an
+				// app-connector candidate.
+				Advertise: len(services) > 0,
+			},
+		},
+		AdvertiseTagsSet:   len(tags) > 0,
+		AdvertiseRoutesSet: len(routes) > 0,
+		RouteAllSet:        true,
+		AppConnectorSet:    len(services) > 0,
+	}, nil
+}
@@ -0,0 +1,75 @@
+package tscaddy
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestBuildAdvertisePrefsNoConfig(t *testing.T) {
+	mp, err := buildAdvertisePrefs(nil, nil, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp != nil {
+		t.Fatalf("expected nil MaskedPrefs for an unconfigured node, got %+v", mp)
+	}
+}
+
+func TestBuildAdvertisePrefs(t *testing.T) {
+	mp, err := buildAdvertisePrefs(
+		[]string{"tag:server"},
+		[]string{"10.0.0.0/24"},
+		true, // advertise_exit_node
+		true, // accept_routes
+		[]string{"svc:web"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantRoutes := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+	}
+	if !reflect.DeepEqual(mp.AdvertiseRoutes, wantRoutes) {
+		t.Fatalf("AdvertiseRoutes = %v, want %v", mp.AdvertiseRoutes, wantRoutes)
+	}
+	if !reflect.DeepEqual(mp.AdvertiseTags, []string{"tag:server"}) {
+		t.Fatalf("AdvertiseTags = %v", mp.AdvertiseTags)
+	}
+	if !mp.RouteAll {
+		t.Fatal("expected RouteAll to be set for accept_routes")
+	}
+	if !mp.AppConnector.Advertise {
+		t.Fatal("expected AppConnector.Advertise when advertise_services is set")
+	}
+	if !mp.AdvertiseTagsSet || !mp.AdvertiseRoutesSet || !mp.RouteAllSet || !mp.AppConnectorSet {
+		t.Fatalf("expected all *Set mask flags to be set: %+v", mp)
+	}
+}
+
+func TestBuildAdvertisePrefsExitNodeOnly(t *testing.T) {
+	mp, err := buildAdvertisePrefs(nil, nil, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp == nil {
+		t.Fatal("expected non-nil MaskedPrefs when advertise_exit_node is set")
+	}
+
+	want := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	if !reflect.DeepEqual(mp.AdvertiseRoutes, want) {
+		t.Fatalf("AdvertiseRoutes = %v, want %v", mp.AdvertiseRoutes, want)
+	}
+	if mp.RouteAll {
+		t.Fatal("accept_routes was not requested, RouteAll should be false")
+	}
+}
+
+func TestBuildAdvertisePrefsInvalidRoute(t *testing.T) {
+	if _, err := buildAdvertisePrefs(nil, []string{"not-a-cidr"}, false, false, nil); err == nil {
+		t.Fatal("expected an error for an invalid advertise_routes CIDR")
+	}
+}
@@ -9,32 +9,46 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/certmagic"
 	"github.com/tailscale/tscert"
 	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
 func init() {
 	caddy.RegisterNetwork("tailscale", getTCPListener)
 	caddy.RegisterNetwork("tailscale+tls", getTLSListener)
+	caddy.RegisterNetwork("tailscale+funnel", getFunnelListener)
 	caddy.RegisterNetwork("tailscale/udp", getUDPListener)
 	caddyhttp.RegisterNetworkHTTP3("tailscale", "tailscale/udp")
 
 	// Caddy uses tscert to get certificates for Tailscale hostnames.
-	// Update the tscert dialer to dial the LocalAPI of the correct tsnet node,
-	// rather than just always dialing the local tailscaled.
-	tscert.TailscaledDialer = localAPIDialer
+	// Update the tscert transport to dial the LocalAPI of the correct tsnet node,
+	// rather than just always dialing the local tailscaled, or pinning to
+	// whichever node tscert happened to dial first.
+	tscert.TailscaledTransport = localTransport
 }
 
+// localTransport is the single localAPITransport instance assigned to
+// tscert.TailscaledTransport. It's package-level (rather than per-node) so
+// tailscaleNode.Destruct can evict a destroyed node's cached *http.Transport
+// from it.
+var localTransport = &localAPITransport{}
+
 func getTCPListener(c context.Context, _ string, addr string, _ net.ListenConfig) (any, error) {
 	ctx, ok := c.(caddy.Context)
 	if !ok {
@@ -90,7 +104,15 @@ func getTLSListener(c context.Context, _ string, addr string, _ net.ListenConfig
 	return ln, nil
 }
 
-func getUDPListener(c context.Context, _ string, addr string, _ net.ListenConfig) (any, error) {
+// funnelPorts are the only ports Tailscale Funnel currently allows serving
+// traffic on.
+var funnelPorts = map[string]bool{"443": true, "8443": true, "10000": true}
+
+// getFunnelListener binds a listener that receives traffic from the public
+// internet via Tailscale Funnel, for nodes that have Funnel enabled.
+// Unlike getTLSListener, this exposes the site publicly rather than just to
+// the tailnet.
+func getFunnelListener(c context.Context, _ string, addr string, _ net.ListenConfig) (any, error) {
 	ctx, ok := c.(caddy.Context)
 	if !ok {
 		return nil, fmt.Errorf("context is not a caddy.Context: %T", c)
@@ -101,6 +123,10 @@ func getUDPListener(c context.Context, _ string, addr string, _ net.ListenConfig
 		return nil, err
 	}
 
+	if !funnelPorts[port] {
+		return nil, fmt.Errorf("tailscale+funnel: port %q is not allowed; Tailscale Funnel only serves ports 443, 8443, and 10000", port)
+	}
+
 	s, err := getNode(ctx, host)
 	if err != nil {
 		return nil, err
@@ -110,23 +136,289 @@ func getUDPListener(c context.Context, _ string, addr string, _ net.ListenConfig
 	if err != nil {
 		return nil, err
 	}
+	if !hasFunnelCapability(st) {
+		return nil, fmt.Errorf("tailscale+funnel: node %q does not have Funnel enabled for it in the admin console and ACLs; see https://tailscale.com/kb/1223/funnel", host)
+	}
+
+	if network == "" {
+		network = "tcp"
+	}
+
+	ln, err := s.ListenFunnel(network, ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("tailscale+funnel: %w", err)
+	}
+
+	return ln, nil
+}
+
+// hasFunnelCapability reports whether the node's control status grants it
+// the Funnel capability, so getFunnelListener can surface a clear,
+// purpose-built error instead of whatever ListenFunnel itself returns.
+func hasFunnelCapability(st *ipnstate.Status) bool {
+	if st == nil || st.Self == nil {
+		return false
+	}
+	for _, c := range st.Self.Capabilities {
+		if c == tailcfg.CapabilityFunnel {
+			return true
+		}
+	}
+	if _, ok := st.Self.CapMap[tailcfg.CapabilityFunnel]; ok {
+		return true
+	}
+	return false
+}
+
+func getUDPListener(c context.Context, _ string, addr string, _ net.ListenConfig) (any, error) {
+	ctx, ok := c.(caddy.Context)
+	if !ok {
+		return nil, fmt.Errorf("context is not a caddy.Context: %T", c)
+	}
+
+	network, host, port, err := caddy.SplitNetworkAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := getNode(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	appIface, err := ctx.App("tailscale")
+	if err != nil {
+		return nil, err
+	}
+	app := appIface.(*App)
 
 	if network == "" {
 		network = "udp4"
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRebindingPacketConn(context.Background(), s, host, network, uint16(p), app)
+}
+
+// rebindingPacketConn is a net.PacketConn bound to one of a tsnet node's
+// Tailscale IPs that transparently rebinds to a new address when the node's
+// netmap reassigns its IP, e.g. after re-authentication. Without this,
+// HTTP/3 listeners silently stop receiving traffic once the bound IP is no
+// longer assigned to the node.
+type rebindingPacketConn struct {
+	s       *tailscaleNode
+	name    string
+	network string
+	port    uint16
+	app     *App
+
+	mu   sync.RWMutex
+	pc   *trackedPacketConn
+	addr netip.Addr
+}
+
+// trackedPacketConn wraps a net.PacketConn with a WaitGroup tracking reads
+// and writes in flight, so a rebind can wait for them to finish before
+// closing the old conn out from under them.
+type trackedPacketConn struct {
+	net.PacketConn
+	inFlight sync.WaitGroup
+}
+
+func (c *trackedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.inFlight.Add(1)
+	defer c.inFlight.Done()
+	return c.PacketConn.ReadFrom(b)
+}
+
+func (c *trackedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.inFlight.Add(1)
+	defer c.inFlight.Done()
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newRebindingPacketConn(ctx context.Context, s *tailscaleNode, name string, network string, port uint16, app *App) (*rebindingPacketConn, error) {
+	st, err := s.Up(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.BackendState == "NeedsMachineAuth" {
+		// The node's auth key (minted via OAuth client credentials, if
+		// configured) already burned its single use. Re-mint and
+		// re-authenticate in place rather than leaving the listener dead.
+		if err := reauthorizeNode(ctx, s, name, app); err != nil {
+			app.logger.Error("tailscale: failed to reauthorize node", zap.String("node", name), zap.Error(err))
+		}
+	}
+
+	addr, ok := tailscaleIPForNetwork(st.TailscaleIPs, network)
+	if !ok {
+		return nil, fmt.Errorf("no %s address assigned to node %q", network, s.Hostname)
+	}
+
+	pc, err := s.Server.ListenPacket(network, netip.AddrPortFrom(addr, port).String())
+	if err != nil {
+		return nil, err
+	}
 
+	r := &rebindingPacketConn{
+		s:       s,
+		name:    name,
+		network: network,
+		port:    port,
+		app:     app,
+		pc:      &trackedPacketConn{PacketConn: pc},
+		addr:    addr,
 	}
-	var ap netip.AddrPort
-	for _, ip := range st.TailscaleIPs {
-		// TODO(will): watch for Tailscale IP changes and update listener
+	go r.watchNetMap(ctx)
+	return r, nil
+}
+
+// tailscaleIPForNetwork returns the first address in ips matching network
+// ("udp4" or "udp6").
+func tailscaleIPForNetwork(ips []netip.Addr, network string) (netip.Addr, bool) {
+	for _, ip := range ips {
 		if (network == "udp4" && ip.Is4()) || (network == "udp6" && ip.Is6()) {
-			p, _ := strconv.Atoi(port)
-			ap = netip.AddrPortFrom(ip, uint16(p))
-			break
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// prefixAddrs returns the host address of each prefix in prefixes, dropping
+// the routing mask. NetworkMap.Addresses is a []netip.Prefix (each address is
+// really a /32 or /128), but tailscaleIPForNetwork compares bare addresses.
+func prefixAddrs(prefixes []netip.Prefix) []netip.Addr {
+	addrs := make([]netip.Addr, len(prefixes))
+	for i, p := range prefixes {
+		addrs[i] = p.Addr()
+	}
+	return addrs
+}
+
+// watchNetMap subscribes to the node's ipn.Notify bus and rebinds the
+// listener whenever the netmap reassigns the node's address.
+func (r *rebindingPacketConn) watchNetMap(ctx context.Context) {
+	lc, err := r.s.LocalClient()
+	if err != nil {
+		r.app.logger.Error("tailscale: could not watch netmap for UDP rebind", zap.Error(err))
+		return
+	}
+
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		r.app.logger.Error("tailscale: could not watch netmap for UDP rebind", zap.Error(err))
+		return
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return
 		}
+		if n.NetMap == nil {
+			continue
+		}
+
+		addr, ok := tailscaleIPForNetwork(prefixAddrs(n.NetMap.Addresses), r.network)
+		if !ok || addr == r.currentAddr() {
+			continue
+		}
+		if err := r.rebind(ctx, addr); err != nil {
+			r.app.logger.Error("tailscale: failed to rebind UDP listener", zap.Stringer("addr", addr), zap.Error(err))
+		}
+	}
+}
+
+func (r *rebindingPacketConn) currentAddr() netip.Addr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.addr
+}
+
+// rebind opens a new PacketConn on addr, swaps it in, and closes the old
+// conn once any reads/writes in flight on it have drained.
+func (r *rebindingPacketConn) rebind(ctx context.Context, addr netip.Addr) error {
+	pc, err := r.s.Server.ListenPacket(r.network, netip.AddrPortFrom(addr, r.port).String())
+	if err != nil {
+		return err
 	}
-	return s.Server.ListenPacket(network, ap.String())
+
+	r.swap(pc, addr)
+	return nil
 }
 
+// swap installs pc as the active conn for addr, closing the previous conn
+// only once any reads/writes in flight on it have drained. Split out from
+// rebind so the swap/drain behavior can be unit tested with a fake
+// net.PacketConn, without needing a real tsnet.Server listening socket.
+func (r *rebindingPacketConn) swap(pc net.PacketConn, addr netip.Addr) {
+	r.mu.Lock()
+	old := r.pc
+	r.pc = &trackedPacketConn{PacketConn: pc}
+	r.addr = addr
+	r.mu.Unlock()
+
+	r.app.logger.Info("tailscale: UDP listener rebound to new address", zap.Stringer("addr", addr))
+
+	go func() {
+		old.inFlight.Wait()
+		old.PacketConn.Close()
+	}()
+}
+
+func (r *rebindingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	r.mu.RLock()
+	pc := r.pc
+	r.mu.RUnlock()
+	return pc.ReadFrom(b)
+}
+
+func (r *rebindingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	r.mu.RLock()
+	pc := r.pc
+	r.mu.RUnlock()
+	return pc.WriteTo(b, addr)
+}
+
+func (r *rebindingPacketConn) Close() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pc.Close()
+}
+
+func (r *rebindingPacketConn) LocalAddr() net.Addr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pc.LocalAddr()
+}
+
+func (r *rebindingPacketConn) SetDeadline(t time.Time) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pc.SetDeadline(t)
+}
+
+func (r *rebindingPacketConn) SetReadDeadline(t time.Time) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pc.SetReadDeadline(t)
+}
+
+func (r *rebindingPacketConn) SetWriteDeadline(t time.Time) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pc.SetWriteDeadline(t)
+}
+
+// Interface guard.
+var _ net.PacketConn = (*rebindingPacketConn)(nil)
+
 // nodes are the Tailscale nodes that have been configured and started.
 // Node configuration comes from the global Tailscale Caddy app.
 // When nodes are no longer in used (e.g. all listeners have been closed), they are shutdown.
@@ -168,16 +460,41 @@ func getNode(ctx caddy.Context, name string) (*tailscaleNode, error) {
 			return nil, err
 		}
 
-		if s.Dir, err = getStateDir(name, app); err != nil {
+		store, err := getStore(ctx, name, app)
+		if err != nil {
+			return nil, err
+		}
+		if store != nil {
+			// A Store module was provisioned for this node, so state lives
+			// wherever that module puts it (e.g. a Kubernetes Secret or an
+			// SSM parameter). Skip the default state directory entirely;
+			// creating it would be both unnecessary and, in read-only
+			// containers, impossible.
+			s.Store = store
+		} else {
+			if s.Dir, err = getStateDir(name, app); err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(s.Dir, 0700); err != nil {
+				return nil, err
+			}
+		}
+
+		node := &tailscaleNode{Server: s, name: name}
+
+		if _, err := node.Up(context.Background()); err != nil {
 			return nil, err
 		}
-		if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		if err := configureAdvertising(context.Background(), node, name, app); err != nil {
+			node.Close()
+			return nil, err
+		}
+		if err := startProxies(node, name, app); err != nil {
+			node.Close()
 			return nil, err
 		}
 
-		return &tailscaleNode{
-			s,
-		}, nil
+		return node, nil
 	})
 	if err != nil {
 		return nil, err
@@ -193,11 +510,17 @@ func getAuthKey(name string, app *App) (string, error) {
 		if node.AuthKey != "" {
 			return repl.ReplaceOrErr(node.AuthKey, true, true)
 		}
+		if node.OAuthClientID != "" && node.OAuthClientSecret != "" {
+			return mintAuthKey(name, node.OAuthClientID, node.OAuthClientSecret, node.OAuthTags)
+		}
 	}
 
 	if app.DefaultAuthKey != "" {
 		return repl.ReplaceOrErr(app.DefaultAuthKey, true, true)
 	}
+	if app.OAuthClientID != "" && app.OAuthClientSecret != "" {
+		return mintAuthKey(name, app.OAuthClientID, app.OAuthClientSecret, app.OAuthTags)
+	}
 
 	// Set authkey to "TS_AUTHKEY_<HOST>".
 	// If empty, fall back to "TS_AUTHKEY".
@@ -265,6 +588,27 @@ func getStateDir(name string, app *App) (string, error) {
 	return filepath.Join(configDir, "tsnet-caddy-"+name), nil
 }
 
+// getStore returns the provisioned Store module for the node, or nil if
+// the node has no store configured, in which case getNode falls back to
+// the default file-based state directory.
+func getStore(ctx caddy.Context, name string, app *App) (Store, error) {
+	node, ok := app.Nodes[name]
+	if !ok || node.Store == nil {
+		return nil, nil
+	}
+
+	mod, err := ctx.LoadModule(node, "Store")
+	if err != nil {
+		return nil, fmt.Errorf("loading store module for node %q: %w", name, err)
+	}
+
+	store, ok := mod.(Store)
+	if !ok {
+		return nil, fmt.Errorf("module for node %q is not a tailscale.stores.* module: %T", name, mod)
+	}
+	return store, nil
+}
+
 func getWebUI(name string, app *App) bool {
 	if node, ok := app.Nodes[name]; ok {
 		if v, ok := node.WebUI.Get(); ok {
@@ -278,9 +622,25 @@ func getWebUI(name string, app *App) bool {
 // This node can listen on the tailscale network interface, or be used to connect to other nodes in the tailnet.
 type tailscaleNode struct {
 	*tsnet.Server
+
+	// name is the node's config key in nodes/app.Nodes, used to evict its
+	// cached OAuth auth key (see authKeys in oauth.go) on Destruct.
+	name string
+
+	// proxyListeners are the SOCKS5/HTTP CONNECT proxy listeners bound for
+	// this node by startProxies, if any. Closed alongside the node so a
+	// Caddy reload that destroys and recreates the node doesn't leak them.
+	proxyListeners []net.Listener
 }
 
-func (t tailscaleNode) Destruct() error {
+func (t *tailscaleNode) Destruct() error {
+	// Pointer receiver so forget() evicts by the same *tailscaleNode that
+	// was used as the cache key in transportFor, not a copy's address.
+	localTransport.forget(t)
+	authKeys.Delete(t.name)
+	for _, ln := range t.proxyListeners {
+		ln.Close()
+	}
 	return t.Close()
 }
 
@@ -296,6 +656,18 @@ func (t *tailscaleNode) Listen(network string, addr string) (net.Listener, error
 	return serverListener, nil
 }
 
+func (t *tailscaleNode) ListenFunnel(network string, addr string) (net.Listener, error) {
+	ln, err := t.Server.ListenFunnel(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	serverListener := &tsnetServerListener{
+		name:     t.Hostname,
+		Listener: ln,
+	}
+	return serverListener, nil
+}
+
 type tsnetServerListener struct {
 	name string
 	net.Listener
@@ -312,27 +684,84 @@ func (t *tsnetServerListener) Close() error {
 	return err
 }
 
-// localAPIDialer finds the node that matches the requested certificate in ctx
-// and dials that node's local API.
-// If no matching node is found, the default dialer is used,
-// which tries to connect to a local tailscaled on the machine.
-func localAPIDialer(ctx context.Context, network, addr string) (net.Conn, error) {
-	if addr != "local-tailscaled.sock:80" {
-		return nil, fmt.Errorf("unexpected URL address %q", addr)
-	}
+// localAPITransport is an http.RoundTripper that dispatches tscert's LocalAPI
+// requests to the tsnet node matching the TLS ClientHello carried on the
+// request's context, rather than tscert's default behavior of caching a
+// single http.Transport built from whichever node it dialed first.
+//
+// This matters once more than one tsnet.Server is registered: without it,
+// LocalAPI requests for a second node's certificate would be sent to the
+// first node's LocalAPI, producing wrong-certificate errors under Caddy
+// auto-HTTPS.
+type localAPITransport struct {
+	mu         sync.Mutex
+	transports map[*tailscaleNode]*http.Transport
+}
 
-	clientHello, ok := ctx.Value(certmagic.ClientHelloInfoCtxKey).(*tls.ClientHelloInfo)
+func (t *localAPITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clientHello, ok := req.Context().Value(certmagic.ClientHelloInfoCtxKey).(*tls.ClientHelloInfo)
 	if !ok || clientHello == nil {
-		return tscert.DialLocalAPI(ctx, network, addr)
+		return tscert.NewRoundRobinTransport().RoundTrip(req)
 	}
 
+	tn := nodeForServerName(clientHello.ServerName)
+	if tn == nil {
+		return tscert.NewRoundRobinTransport().RoundTrip(req)
+	}
+
+	lc, err := tn.LocalClient()
+	if err != nil {
+		return tscert.NewRoundRobinTransport().RoundTrip(req)
+	}
+
+	return t.transportFor(tn, lc.Dial).RoundTrip(req)
+}
+
+// transportFor returns the cached http.Transport for tn, dialing through
+// dial, creating one if this is the first request seen for tn.
+func (t *localAPITransport) transportFor(tn *tailscaleNode, dial func(context.Context, string, string) (net.Conn, error)) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tr, ok := t.transports[tn]; ok {
+		return tr
+	}
+
+	tr := &http.Transport{DialContext: dial}
+	if t.transports == nil {
+		t.transports = make(map[*tailscaleNode]*http.Transport)
+	}
+	t.transports[tn] = tr
+	return tr
+}
+
+// forget evicts and closes the cached transport for tn, if any. Called when
+// tn is destroyed so a Caddy reload (or a node's usage count dropping to
+// zero and later being recreated) doesn't leak a *http.Transport, and the
+// idle connections it's holding, for the node's old pointer forever.
+func (t *localAPITransport) forget(tn *tailscaleNode) {
+	t.mu.Lock()
+	tr, ok := t.transports[tn]
+	if ok {
+		delete(t.transports, tn)
+	}
+	t.mu.Unlock()
+
+	if ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// nodeForServerName finds the registered node whose CertDomains match the
+// given TLS server name.
+// Tailscale doesn't do wildcard certs, but caddy uses MatchWildcard
+// for the built-in Tailscale cert manager, so we do so here as well.
+func nodeForServerName(serverName string) *tailscaleNode {
 	var tn *tailscaleNode
 	nodes.Range(func(key, value any) bool {
 		if n, ok := value.(*tailscaleNode); ok && n != nil {
 			for _, d := range n.CertDomains() {
-				// Tailscale doesn't do wildcard certs, but caddy uses MatchWildcard
-				// for the built-in Tailscale cert manager, so we do so here as well.
-				if certmagic.MatchWildcard(clientHello.ServerName, d) {
+				if certmagic.MatchWildcard(serverName, d) {
 					tn = n
 					return false
 				}
@@ -340,12 +769,5 @@ func localAPIDialer(ctx context.Context, network, addr string) (net.Conn, error)
 		}
 		return true
 	})
-
-	if tn != nil {
-		if lc, err := tn.LocalClient(); err == nil {
-			return lc.Dial(ctx, network, addr)
-		}
-	}
-
-	return tscert.DialLocalAPI(ctx, network, addr)
+	return tn
 }
@@ -0,0 +1,116 @@
+package tscaddy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTailscaleIPForNetwork(t *testing.T) {
+	v4 := netip.MustParseAddr("100.64.0.1")
+	v6 := netip.MustParseAddr("fd7a:115c:a1e0::1")
+	ips := []netip.Addr{v4, v6}
+
+	got, ok := tailscaleIPForNetwork(ips, "udp4")
+	if !ok || got != v4 {
+		t.Fatalf("udp4: got (%v, %v), want (%v, true)", got, ok, v4)
+	}
+
+	got, ok = tailscaleIPForNetwork(ips, "udp6")
+	if !ok || got != v6 {
+		t.Fatalf("udp6: got (%v, %v), want (%v, true)", got, ok, v6)
+	}
+
+	if _, ok := tailscaleIPForNetwork(nil, "udp4"); ok {
+		t.Fatal("expected no match for an empty address list")
+	}
+}
+
+func TestPrefixAddrs(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.1/32"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::1/128"),
+	}
+
+	got := prefixAddrs(prefixes)
+	want := []netip.Addr{
+		netip.MustParseAddr("100.64.0.1"),
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("prefixAddrs(%v) = %v, want %v", prefixes, got, want)
+	}
+
+	if got := prefixAddrs(nil); len(got) != 0 {
+		t.Fatalf("prefixAddrs(nil) = %v, want empty", got)
+	}
+}
+
+// blockingPacketConn is a net.PacketConn whose ReadFrom blocks until
+// unblock is closed, so a test can hold a read "in flight" across a swap.
+type blockingPacketConn struct {
+	net.PacketConn
+	unblock chan struct{}
+	closed  chan struct{}
+}
+
+func newBlockingPacketConn() *blockingPacketConn {
+	return &blockingPacketConn{unblock: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *blockingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	<-c.unblock
+	return 0, nil, net.ErrClosed
+}
+
+func (c *blockingPacketConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestRebindingPacketConnSwapDrainsInFlight(t *testing.T) {
+	oldConn := newBlockingPacketConn()
+	newConn := newBlockingPacketConn()
+
+	r := &rebindingPacketConn{
+		network: "udp4",
+		port:    1234,
+		app:     &App{logger: zap.NewNop()},
+		pc:      &trackedPacketConn{PacketConn: oldConn},
+		addr:    netip.MustParseAddr("100.64.0.1"),
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		r.ReadFrom(make([]byte, 1))
+		close(readDone)
+	}()
+
+	// Give the goroutine above a chance to register its read as in-flight
+	// before swapping underneath it.
+	time.Sleep(10 * time.Millisecond)
+
+	r.swap(newConn, netip.MustParseAddr("100.64.0.2"))
+
+	select {
+	case <-oldConn.closed:
+		t.Fatal("old conn was closed before its in-flight read drained")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(oldConn.unblock)
+	<-readDone
+
+	select {
+	case <-oldConn.closed:
+	case <-time.After(time.Second):
+		t.Fatal("old conn was never closed after its in-flight read drained")
+	}
+
+	if got := r.currentAddr(); got != netip.MustParseAddr("100.64.0.2") {
+		t.Fatalf("addr not updated after swap: got %v", got)
+	}
+}
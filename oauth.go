@@ -0,0 +1,167 @@
+package tscaddy
+
+// oauth.go lets a node authenticate with a Tailscale API OAuth client
+// ID/secret instead of a static AuthKey. Static auth keys expire in at most
+// 90 days and need manual rotation; OAuth client secrets are long-lived, so
+// this is what makes it feasible to run caddy-tailscale in immutable
+// containers without periodic reconfiguration.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"tailscale.com/ipn"
+)
+
+// tsAPIBaseURL is the base URL of the Tailscale API. Overridable in tests.
+var tsAPIBaseURL = "https://api.tailscale.com/api/v2"
+
+// authKeys caches the ephemeral auth key minted for each OAuth-configured
+// node, so it's only minted once for the node's lifetime.
+var authKeys sync.Map // name string -> key string
+
+// mintAuthKey returns the cached auth key for name, minting a new ephemeral,
+// preauthorized, single-use key via the Tailscale API if none is cached yet.
+func mintAuthKey(name, clientID, clientSecret string, tags []string) (string, error) {
+	if key, ok := authKeys.Load(name); ok {
+		return key.(string), nil
+	}
+
+	key, err := createEphemeralAuthKey(context.Background(), clientID, clientSecret, tags)
+	if err != nil {
+		return "", fmt.Errorf("minting auth key for node %q: %w", name, err)
+	}
+
+	authKeys.Store(name, key)
+	return key, nil
+}
+
+// reauthorizeNode re-mints app's OAuth-backed auth key for the node
+// registered under name and re-authenticates its already-running
+// tsnet.Server with it. It's a no-op if the node isn't configured with
+// OAuth credentials.
+func reauthorizeNode(ctx context.Context, s *tailscaleNode, name string, app *App) error {
+	clientID, clientSecret, tags := app.OAuthClientID, app.OAuthClientSecret, app.OAuthTags
+	if node, ok := app.Nodes[name]; ok && node.OAuthClientID != "" && node.OAuthClientSecret != "" {
+		clientID, clientSecret, tags = node.OAuthClientID, node.OAuthClientSecret, node.OAuthTags
+	}
+	if clientID == "" || clientSecret == "" {
+		return nil
+	}
+
+	authKeys.Delete(name)
+	authKey, err := mintAuthKey(name, clientID, clientSecret, tags)
+	if err != nil {
+		return err
+	}
+
+	lc, err := s.LocalClient()
+	if err != nil {
+		return err
+	}
+	return lc.Start(ctx, ipn.Options{AuthKey: authKey})
+}
+
+// createEphemeralAuthKey exchanges clientID/clientSecret for an OAuth access
+// token, then uses it to mint an ephemeral, preauthorized, single-use auth
+// key tagged with tags.
+func createEphemeralAuthKey(ctx context.Context, clientID, clientSecret string, tags []string) (string, error) {
+	token, err := fetchOAuthToken(ctx, clientID, clientSecret)
+	if err != nil {
+		return "", fmt.Errorf("fetching OAuth token: %w", err)
+	}
+
+	reqBody := keyCreateRequest{}
+	reqBody.Capabilities.Devices.Create.Ephemeral = true
+	reqBody.Capabilities.Devices.Create.Preauthorized = true
+	reqBody.Capabilities.Devices.Create.Tags = tags
+
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, tsAPIBaseURL+"/tailnet/-/keys", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("creating auth key: %s: %s", resp.Status, b)
+	}
+
+	var keyResp keyCreateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&keyResp); err != nil {
+		return "", err
+	}
+	return keyResp.Key, nil
+}
+
+// fetchOAuthToken exchanges clientID/clientSecret for a short-lived access
+// token scoped to "devices", per Tailscale's OAuth client credentials flow.
+func fetchOAuthToken(ctx context.Context, clientID, clientSecret string) (string, error) {
+	form := url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"grant_type":    {"client_credentials"},
+		"scope":         {"devices"},
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, tsAPIBaseURL+"/oauth/token", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("%s: %s", resp.Status, b)
+	}
+
+	var tokResp oauthTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokResp); err != nil {
+		return "", err
+	}
+	return tokResp.AccessToken, nil
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+type keyCreateRequest struct {
+	Capabilities struct {
+		Devices struct {
+			Create struct {
+				Ephemeral     bool     `json:"ephemeral"`
+				Preauthorized bool     `json:"preauthorized"`
+				Tags          []string `json:"tags"`
+			} `json:"create"`
+		} `json:"devices"`
+	} `json:"capabilities"`
+}
+
+type keyCreateResponse struct {
+	Key string `json:"key"`
+}
@@ -0,0 +1,152 @@
+package tscaddy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// withTestAPIServer points tsAPIBaseURL at srv for the duration of the test.
+func withTestAPIServer(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	orig := tsAPIBaseURL
+	tsAPIBaseURL = srv.URL
+	t.Cleanup(func() { tsAPIBaseURL = orig })
+}
+
+func TestFetchOAuthToken(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Form.Get("client_id"); got != "client-id" {
+			t.Errorf("client_id = %q, want %q", got, "client-id")
+		}
+		if got := r.Form.Get("client_secret"); got != "client-secret" {
+			t.Errorf("client_secret = %q, want %q", got, "client-secret")
+		}
+		if got := r.Form.Get("grant_type"); got != "client_credentials" {
+			t.Errorf("grant_type = %q, want %q", got, "client_credentials")
+		}
+		if got := r.Form.Get("scope"); got != "devices" {
+			t.Errorf("scope = %q, want %q", got, "devices")
+		}
+		fmt.Fprint(w, `{"access_token":"test-token"}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withTestAPIServer(t, srv)
+
+	token, err := fetchOAuthToken(context.Background(), "client-id", "client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "test-token" {
+		t.Fatalf("token = %q, want %q", token, "test-token")
+	}
+}
+
+func TestFetchOAuthTokenError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	withTestAPIServer(t, srv)
+
+	if _, err := fetchOAuthToken(context.Background(), "bad", "creds"); err == nil {
+		t.Fatal("expected an error for a non-200 token response")
+	}
+}
+
+func TestCreateEphemeralAuthKey(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"test-token"}`)
+	})
+	mux.HandleFunc("/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer test-token")
+		}
+
+		var req keyCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if !req.Capabilities.Devices.Create.Ephemeral {
+			t.Error("expected ephemeral to be set")
+		}
+		if !req.Capabilities.Devices.Create.Preauthorized {
+			t.Error("expected preauthorized to be set")
+		}
+		if len(req.Capabilities.Devices.Create.Tags) != 1 || req.Capabilities.Devices.Create.Tags[0] != "tag:server" {
+			t.Errorf("tags = %v, want [tag:server]", req.Capabilities.Devices.Create.Tags)
+		}
+
+		fmt.Fprint(w, `{"key":"tskey-auth-test"}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withTestAPIServer(t, srv)
+
+	key, err := createEphemeralAuthKey(context.Background(), "client-id", "client-secret", []string{"tag:server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "tskey-auth-test" {
+		t.Fatalf("key = %q, want %q", key, "tskey-auth-test")
+	}
+}
+
+func TestCreateEphemeralAuthKeyError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"test-token"}`)
+	})
+	mux.HandleFunc("/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withTestAPIServer(t, srv)
+
+	if _, err := createEphemeralAuthKey(context.Background(), "client-id", "client-secret", nil); err == nil {
+		t.Fatal("expected an error for a non-200 key-create response")
+	}
+}
+
+func TestMintAuthKeyCaches(t *testing.T) {
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"test-token"}`)
+	})
+	mux.HandleFunc("/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"key":"tskey-auth-test"}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withTestAPIServer(t, srv)
+
+	const name = "test-mint-auth-key-caches"
+	t.Cleanup(func() { authKeys.Delete(name) })
+
+	for i := 0; i < 3; i++ {
+		key, err := mintAuthKey(name, "client-id", "client-secret", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "tskey-auth-test" {
+			t.Fatalf("key = %q, want %q", key, "tskey-auth-test")
+		}
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("key-create requests = %d, want 1 (key should be cached after the first mint)", got)
+	}
+}
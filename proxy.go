@@ -0,0 +1,116 @@
+package tscaddy
+
+// proxy.go exposes each tsnet node's dialer as a local SOCKS5 and HTTP
+// CONNECT proxy via the socks5_listen and http_proxy_listen node options.
+// This gives operators a stable 127.0.0.1 endpoint that any Caddy
+// reverse_proxy block, or a non-Caddy sidecar in the same pod, can dial
+// through to reach tailnet-only backends without linking tsnet directly.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+	"tailscale.com/net/socks5"
+)
+
+// startProxies binds the node's configured socks5_listen and
+// http_proxy_listen addresses, if any, proxying outbound connections
+// through the node's own tsnet dialer. It's a no-op if neither is
+// configured. On success the listeners are recorded on s.proxyListeners so
+// tailscaleNode's Destruct closes them along with the node; if binding one
+// fails, any listener already bound here is closed before returning.
+func startProxies(s *tailscaleNode, name string, app *App) error {
+	node, ok := app.Nodes[name]
+	if !ok {
+		return nil
+	}
+
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+
+	if node.SOCKS5Listen != "" {
+		ln, err := net.Listen("tcp", node.SOCKS5Listen)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listening for SOCKS5 proxy on %q: %w", node.SOCKS5Listen, err)
+		}
+		listeners = append(listeners, ln)
+
+		srv := &socks5.Server{Dialer: s.Dial}
+		go func() {
+			if err := srv.Serve(ln); err != nil {
+				app.logger.Error("tailscale: SOCKS5 proxy stopped", zap.String("node", name), zap.Error(err))
+			}
+		}()
+	}
+
+	if node.HTTPProxyListen != "" {
+		ln, err := net.Listen("tcp", node.HTTPProxyListen)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listening for HTTP proxy on %q: %w", node.HTTPProxyListen, err)
+		}
+		listeners = append(listeners, ln)
+
+		go func() {
+			if err := http.Serve(ln, &connectProxy{dial: s.Dial}); err != nil {
+				app.logger.Error("tailscale: HTTP proxy stopped", zap.String("node", name), zap.Error(err))
+			}
+		}()
+	}
+
+	s.proxyListeners = listeners
+	return nil
+}
+
+// connectProxy is a minimal HTTP CONNECT proxy that tunnels connections
+// through dial, so an HTTP_PROXY-aware client (including Caddy's
+// `transport http`) can reach tailnet-only backends.
+type connectProxy struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dst, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer dst.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	src, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+
+	if _, err := src.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// Close the peer conn as soon as either direction finishes, so a
+	// half-closed or idle side doesn't hang the tunnel open waiting for the
+	// other to also finish.
+	go func() { io.Copy(dst, src); dst.Close() }()
+	io.Copy(src, dst)
+	src.Close()
+}
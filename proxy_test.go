@@ -0,0 +1,128 @@
+package tscaddy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from backend")
+	}))
+	defer backend.Close()
+
+	proxy := httptest.NewServer(&connectProxy{dial: (&net.Dialer{}).DialContext})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	backendAddr := backend.Listener.Addr().String()
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backendAddr, backendAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("reading CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %s", resp.Status)
+	}
+
+	if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", backendAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("hello from backend")) {
+		t.Fatalf("unexpected tunneled response: %s", body)
+	}
+}
+
+// TestConnectProxyClosesOnEitherDirectionFinishing verifies that the proxy
+// tears down the tunnel as soon as one direction finishes, rather than
+// waiting for the client to also hang up. A backend that writes a reply and
+// closes immediately, without waiting to read anything, should still see its
+// half of the tunnel close promptly on the client side.
+func TestConnectProxyClosesOnEitherDirectionFinishing(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello from backend"))
+		conn.Close()
+	}()
+
+	proxy := httptest.NewServer(&connectProxy{dial: (&net.Dialer{}).DialContext})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	backendAddr := backendLn.Addr().String()
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backendAddr, backendAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("reading CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %s", resp.Status)
+	}
+
+	// The client never writes anything or closes its side; if the proxy
+	// waited for both directions to finish (rather than closing as soon as
+	// the backend's direction does), this read would block until the
+	// deadline below instead of seeing EOF promptly.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	body, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("hello from backend")) {
+		t.Fatalf("unexpected tunneled response: %s", body)
+	}
+}
+
+func TestConnectProxyRejectsNonConnect(t *testing.T) {
+	proxy := httptest.NewServer(&connectProxy{dial: (&net.Dialer{}).DialContext})
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %s, want %d", resp.Status, http.StatusMethodNotAllowed)
+	}
+}
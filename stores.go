@@ -0,0 +1,179 @@
+package tscaddy
+
+// stores.go contains pluggable tsnet.Server state store backends, registered
+// as Caddy modules under the "tailscale.stores.*" namespace. A node's Store
+// config (see getStore in module.go) is provisioned through one of these
+// instead of the default state directory, which is what lets caddy-tailscale
+// run statelessly, e.g. in Kubernetes or ECS, with no persistent volume.
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/awsstore"
+	"tailscale.com/ipn/store/kubestore"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	caddy.RegisterModule(StoreFile{})
+	caddy.RegisterModule(StoreMem{})
+	caddy.RegisterModule(StoreKube{})
+	caddy.RegisterModule(StoreAWSSSM{})
+}
+
+// Store is implemented by Caddy modules that provide a tsnet.Server.Store
+// backend. It's satisfied by ipn.StateStore; it exists as its own type so
+// node config can reference it without importing tailscale.com/ipn.
+type Store interface {
+	ipn.StateStore
+}
+
+// StoreFile stores tsnet state in a file on disk, like tsnet's own default.
+// A node with no store module configured does not use this module; getNode
+// gives it a state directory instead and tsnet keeps its own file store there.
+type StoreFile struct {
+	// Path is the file to store state in. Required.
+	Path string `json:"path,omitempty"`
+
+	store ipn.StateStore
+}
+
+// CaddyModule implements caddy.Module.
+func (StoreFile) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.stores.file",
+		New: func() caddy.Module { return new(StoreFile) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *StoreFile) Provision(_ caddy.Context) error {
+	store, err := ipn.NewFileStore(logger.Discard, s.Path)
+	if err != nil {
+		return fmt.Errorf("provisioning file store at %q: %w", s.Path, err)
+	}
+	s.store = store
+	return nil
+}
+
+func (s *StoreFile) ReadState(id ipn.StateKey) ([]byte, error)   { return s.store.ReadState(id) }
+func (s *StoreFile) WriteState(id ipn.StateKey, bs []byte) error { return s.store.WriteState(id, bs) }
+
+// StoreMem stores tsnet state in memory only. State does not survive a
+// restart, so this is only useful for ephemeral nodes that re-authenticate
+// on every start.
+type StoreMem struct {
+	store *mem.Store
+}
+
+// CaddyModule implements caddy.Module.
+func (StoreMem) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.stores.mem",
+		New: func() caddy.Module { return new(StoreMem) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *StoreMem) Provision(_ caddy.Context) error {
+	s.store = new(mem.Store)
+	return nil
+}
+
+func (s *StoreMem) ReadState(id ipn.StateKey) ([]byte, error)   { return s.store.ReadState(id) }
+func (s *StoreMem) WriteState(id ipn.StateKey, bs []byte) error { return s.store.WriteState(id, bs) }
+
+// StoreKube stores tsnet state in a Kubernetes Secret via
+// tailscale.com/ipn/store/kubestore, so a node's Pod needs no persistent
+// volume.
+type StoreKube struct {
+	// SecretName is the Kubernetes Secret to store state in. If empty,
+	// falls back to the TS_KUBE_SECRET env var, matching kubestore's own
+	// convention.
+	SecretName string `json:"secret_name,omitempty"`
+
+	store *kubestore.Store
+}
+
+// CaddyModule implements caddy.Module.
+func (StoreKube) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.stores.kube",
+		New: func() caddy.Module { return new(StoreKube) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *StoreKube) Provision(_ caddy.Context) error {
+	name := s.SecretName
+	if name == "" {
+		name = os.Getenv("TS_KUBE_SECRET")
+	}
+
+	store, err := kubestore.New(logger.Discard, name)
+	if err != nil {
+		return fmt.Errorf("provisioning kube store for secret %q: %w", name, err)
+	}
+	s.store = store
+	return nil
+}
+
+func (s *StoreKube) ReadState(id ipn.StateKey) ([]byte, error)   { return s.store.ReadState(id) }
+func (s *StoreKube) WriteState(id ipn.StateKey, bs []byte) error { return s.store.WriteState(id, bs) }
+
+// StoreAWSSSM stores tsnet state in an AWS SSM Parameter Store parameter via
+// tailscale.com/ipn/store/awsstore, so a node can run statelessly in
+// ECS/Fargate.
+type StoreAWSSSM struct {
+	// ParameterName is the SSM parameter to store state in. Required.
+	ParameterName string `json:"parameter_name,omitempty"`
+	// KMSKeyID, if set, encrypts the parameter with this KMS key.
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	store *awsstore.Store
+}
+
+// CaddyModule implements caddy.Module.
+func (StoreAWSSSM) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale.stores.aws_ssm",
+		New: func() caddy.Module { return new(StoreAWSSSM) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *StoreAWSSSM) Provision(_ caddy.Context) error {
+	arn := s.ParameterName
+	if s.KMSKeyID != "" {
+		arn = fmt.Sprintf("%s?kmskey=%s", arn, s.KMSKeyID)
+	}
+
+	store, err := awsstore.New(logger.Discard, arn)
+	if err != nil {
+		return fmt.Errorf("provisioning AWS SSM store for parameter %q: %w", s.ParameterName, err)
+	}
+	s.store = store
+	return nil
+}
+
+func (s *StoreAWSSSM) ReadState(id ipn.StateKey) ([]byte, error) { return s.store.ReadState(id) }
+func (s *StoreAWSSSM) WriteState(id ipn.StateKey, bs []byte) error {
+	return s.store.WriteState(id, bs)
+}
+
+// Interface guards.
+var (
+	_ Store = (*StoreFile)(nil)
+	_ Store = (*StoreMem)(nil)
+	_ Store = (*StoreKube)(nil)
+	_ Store = (*StoreAWSSSM)(nil)
+
+	_ caddy.Provisioner = (*StoreFile)(nil)
+	_ caddy.Provisioner = (*StoreMem)(nil)
+	_ caddy.Provisioner = (*StoreKube)(nil)
+	_ caddy.Provisioner = (*StoreAWSSSM)(nil)
+)
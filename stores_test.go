@@ -0,0 +1,49 @@
+package tscaddy
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"tailscale.com/ipn"
+)
+
+func TestStoreMemReadWrite(t *testing.T) {
+	s := &StoreMem{}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ReadState("missing"); err != ipn.ErrStateNotExist {
+		t.Fatalf("ReadState on an unwritten key: got err %v, want %v", err, ipn.ErrStateNotExist)
+	}
+
+	if err := s.WriteState("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.ReadState("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "value" {
+		t.Fatalf("ReadState = %q, want %q", got, "value")
+	}
+}
+
+func TestStoreFileReadWrite(t *testing.T) {
+	s := &StoreFile{Path: filepath.Join(t.TempDir(), "state.json")}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.WriteState("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.ReadState("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "value" {
+		t.Fatalf("ReadState = %q, want %q", got, "value")
+	}
+}